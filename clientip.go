@@ -0,0 +1,122 @@
+// Trusted-proxy aware extraction of the real client IP address from a request forwarded by Traefik.
+// Copyright (C) 2023 Enrico Bassetti
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies is the set of CIDRs configured via -trusted-proxies, i.e. the reverse proxies allowed to set
+// X-Forwarded-For/X-Real-IP on the requests they forward to us.
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses a comma-separated list of CIDRs (or bare IPs, treated as a /32 or /128) from the
+// -trusted-proxies flag value. An empty string yields a nil, empty set.
+func parseTrustedProxies(flagValue string) (trustedProxies, error) {
+	if flagValue == "" {
+		return nil, nil
+	}
+
+	var out trustedProxies
+	for _, entry := range strings.Split(flagValue, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			out = append(out, cidr)
+			continue
+		}
+
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid -trusted-proxies entry %q: not a CIDR or IP address", entry)
+		}
+		bits := 32
+		if ip.To4() == nil {
+			bits = 128
+		}
+		_, cidr, _ := net.ParseCIDR(fmt.Sprintf("%s/%d", ip.String(), bits))
+		out = append(out, cidr)
+	}
+
+	return out, nil
+}
+
+// contains reports whether ip falls within any of the configured CIDRs.
+func (t trustedProxies) contains(ip net.IP) bool {
+	for _, cidr := range t {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerIP returns the IP address of the direct TCP peer that made the request, i.e. r.RemoteAddr without its
+// port.
+func peerIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// clientIP extracts the real client address from r. When trusted proxies are configured, it walks the
+// X-Forwarded-For chain from right to left, skipping hops that belong to a trusted proxy, and returns the first
+// untrusted hop found - that's the address the left-most trusted proxy reported as the client it received the
+// request from. Without -trusted-proxies configured, there is no way to tell which hops (if any) are proxies, so
+// a multi-hop chain falls back to the conventional left-most entry instead, i.e. the one the first proxy in the
+// chain recorded; single-hop chains are unambiguous either way. If X-Forwarded-For yields nothing usable, it
+// falls back to X-Real-IP, and finally to the direct TCP peer address.
+func clientIP(r *http.Request, trusted trustedProxies) net.IP {
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+
+		if len(trusted) == 0 {
+			for _, hop := range hops {
+				if ip := net.ParseIP(strings.TrimSpace(hop)); ip != nil {
+					return ip
+				}
+			}
+		} else {
+			for i := len(hops) - 1; i >= 0; i-- {
+				ip := net.ParseIP(strings.TrimSpace(hops[i]))
+				if ip == nil {
+					continue
+				}
+				if trusted.contains(ip) {
+					continue
+				}
+				return ip
+			}
+		}
+	}
+
+	if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+		if ip := net.ParseIP(strings.TrimSpace(realIP)); ip != nil {
+			return ip
+		}
+	}
+
+	return peerIP(r)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantLen int
+		wantErr bool
+	}{
+		{name: "empty", value: "", wantLen: 0},
+		{name: "single CIDR", value: "10.0.0.0/8", wantLen: 1},
+		{name: "bare IPv4 becomes /32", value: "192.168.1.1", wantLen: 1},
+		{name: "bare IPv6 becomes /128", value: "::1", wantLen: 1},
+		{name: "multiple entries with spaces", value: "10.0.0.0/8, 192.168.1.1", wantLen: 2},
+		{name: "invalid entry", value: "not-an-ip", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := parseTrustedProxies(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseTrustedProxies(%q): expected error, got nil", tt.value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseTrustedProxies(%q): unexpected error: %v", tt.value, err)
+			}
+			if len(out) != tt.wantLen {
+				t.Fatalf("parseTrustedProxies(%q): got %d entries, want %d", tt.value, len(out), tt.wantLen)
+			}
+		})
+	}
+}
+
+func TestTrustedProxiesContains(t *testing.T) {
+	trusted, err := parseTrustedProxies("10.0.0.0/8,192.168.1.1")
+	if err != nil {
+		t.Fatalf("parseTrustedProxies: %v", err)
+	}
+
+	if !trusted.contains(net.ParseIP("10.1.2.3")) {
+		t.Error("expected 10.1.2.3 to be contained in 10.0.0.0/8")
+	}
+	if !trusted.contains(net.ParseIP("192.168.1.1")) {
+		t.Error("expected 192.168.1.1 to be contained as a bare IP")
+	}
+	if trusted.contains(net.ParseIP("8.8.8.8")) {
+		t.Error("expected 8.8.8.8 to not be contained")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies("10.0.0.1,10.0.0.2")
+	if err != nil {
+		t.Fatalf("parseTrustedProxies: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		trusted    trustedProxies
+		xff        string
+		xRealIP    string
+		remoteAddr string
+		wantIP     string
+	}{
+		{
+			name:       "trusted proxies configured skips trusted hops right to left",
+			trusted:    trusted,
+			xff:        "203.0.113.5, 10.0.0.1, 10.0.0.2",
+			remoteAddr: "10.0.0.2:1234",
+			wantIP:     "203.0.113.5",
+		},
+		{
+			name:       "no trusted proxies configured falls back to left-most hop",
+			xff:        "203.0.113.5, 198.51.100.7",
+			remoteAddr: "198.51.100.7:1234",
+			wantIP:     "203.0.113.5",
+		},
+		{
+			name:       "no trusted proxies, single hop",
+			xff:        "203.0.113.5",
+			remoteAddr: "198.51.100.7:1234",
+			wantIP:     "203.0.113.5",
+		},
+		{
+			name:       "falls back to X-Real-IP when X-Forwarded-For is absent",
+			xRealIP:    "203.0.113.5",
+			remoteAddr: "198.51.100.7:1234",
+			wantIP:     "203.0.113.5",
+		},
+		{
+			name:       "falls back to the TCP peer when no headers are set",
+			remoteAddr: "198.51.100.7:1234",
+			wantIP:     "198.51.100.7",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{
+				Header:     http.Header{},
+				RemoteAddr: tt.remoteAddr,
+			}
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if tt.xRealIP != "" {
+				req.Header.Set("X-Real-IP", tt.xRealIP)
+			}
+
+			got := clientIP(req, tt.trusted)
+			want := net.ParseIP(tt.wantIP)
+			if got == nil || !got.Equal(want) {
+				t.Errorf("clientIP() = %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+// Abstraction over the different database formats that can back a country lookup, so that handleRequest doesn't
+// need to know whether it is talking to a MaxMind database or something else.
+// Copyright (C) 2023 Enrico Bassetti
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"github.com/oschwald/geoip2-golang"
+	"github.com/oschwald/maxminddb-golang"
+	"net"
+)
+
+// singGeoipDatabaseType is the DatabaseType metadata value used by databases produced by sing-box's geoip tooling,
+// which store a single ISO country code string per record instead of a MaxMind-style structured record.
+const singGeoipDatabaseType = "sing-geoip"
+
+// CountryLookuper resolves an IP address to an ISO country code. It is implemented by the different database
+// backends handleRequest can be configured with, so that the HTTP handler doesn't need to know which one is in use.
+type CountryLookuper interface {
+	// LookupCountry returns the ISO country code for ip, or an empty string if the database has no opinion on it.
+	LookupCountry(ip net.IP) (string, error)
+	// Metadata returns the underlying database metadata, e.g. to inspect its build epoch.
+	Metadata() maxminddb.Metadata
+	// Close releases the resources held by the underlying database.
+	Close() error
+}
+
+// maxmindCountryLookuper backs CountryLookuper with a geoip2.Reader, for the regular GeoLite2-Country/GeoIP2-Country
+// database formats.
+type maxmindCountryLookuper struct {
+	reader *geoip2.Reader
+}
+
+func (l *maxmindCountryLookuper) LookupCountry(ip net.IP) (string, error) {
+	record, err := l.reader.Country(ip)
+	if err != nil {
+		return "", err
+	}
+	return record.Country.IsoCode, nil
+}
+
+func (l *maxmindCountryLookuper) Metadata() maxminddb.Metadata {
+	return l.reader.Metadata()
+}
+
+func (l *maxmindCountryLookuper) Close() error {
+	return l.reader.Close()
+}
+
+// singGeoipCountryLookuper backs CountryLookuper with a plain maxminddb.Reader, for sing-geoip databases whose
+// records are a bare ISO country code string rather than a structured MaxMind record.
+type singGeoipCountryLookuper struct {
+	reader *maxminddb.Reader
+}
+
+func (l *singGeoipCountryLookuper) LookupCountry(ip net.IP) (string, error) {
+	var country string
+	if err := l.reader.Lookup(ip, &country); err != nil {
+		return "", err
+	}
+	return country, nil
+}
+
+func (l *singGeoipCountryLookuper) Metadata() maxminddb.Metadata {
+	return l.reader.Metadata
+}
+
+func (l *singGeoipCountryLookuper) Close() error {
+	return l.reader.Close()
+}
+
+// openCountryLookuper opens the database at path and returns the CountryLookuper implementation matching its
+// detected format, based on the maxminddb metadata DatabaseType field.
+func openCountryLookuper(path string) (CountryLookuper, error) {
+	probe, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't open database: %w", err)
+	}
+	dbType := probe.Metadata.DatabaseType
+	_ = probe.Close()
+
+	if dbType == singGeoipDatabaseType {
+		reader, err := maxminddb.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("can't open sing-geoip database: %w", err)
+		}
+		return &singGeoipCountryLookuper{reader: reader}, nil
+	}
+
+	reader, err := geoip2.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't open MaxMind database: %w", err)
+	}
+	return &maxmindCountryLookuper{reader: reader}, nil
+}
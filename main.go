@@ -26,6 +26,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
@@ -40,7 +41,8 @@ func main() {
 }
 
 func run() error {
-	var dbpath = flag.String("db", "GeoLite2-Country.mmdb", "Database path")
+	var dbURL = flag.String("db-url", "GeoLite2-Country.mmdb", "Database location. Accepts a plain path, or a file://, http(s):// or s3:// URL.")
+	var dbCacheDir = flag.String("db-cache-dir", filepath.Join(os.TempDir(), "traefik-geoip-forwardauth"), "Directory used to cache databases fetched from http(s):// or s3:// -db-url locations.")
 	var countriesFlag = flag.String("countries", "IT", "Comma separated ISO country codes to allow or block (see action flag)")
 	var action = flag.String("action", "allow", "Action on countries. If \"allow\", only those countries are allowed, others are blocked. If \"block\", only countries are blocked, others are allowed.")
 	var httpTimeouts = flag.Duration("web-timeout", 30*time.Second, "Timeout when reading/writing HTTP")
@@ -48,6 +50,14 @@ func run() error {
 	var allowEmptyCountries = flag.Bool("allow-empty-countries", false, "Whether to allow the request on empty results in country field (default block)")
 	var dbRefreshPeriod = flag.Duration("db-refresh-every", 1*time.Hour, "After this period of time, the database file is re-read.")
 	var debug = flag.Bool("debug", false, "Debug mode (log verbose)")
+	var maxmindAccountID = flag.String("maxmind-account-id", "", "MaxMind account ID. When set together with maxmind-license-key, the database is downloaded and kept up to date automatically.")
+	var maxmindLicenseKey = flag.String("maxmind-license-key", "", "MaxMind license key, used together with maxmind-account-id to download the database automatically.")
+	var maxmindEditionID = flag.String("maxmind-edition-id", "GeoLite2-Country", "MaxMind edition ID to download, e.g. GeoLite2-Country or GeoIP2-Country.")
+	var maxmindMaxAge = flag.Duration("maxmind-max-age", 7*24*time.Hour, "Maximum age of the local database before it is re-downloaded from MaxMind.")
+	var rulesPath = flag.String("rules", "", "Path to a YAML or JSON rules file mixing country, ASN and CIDR matches. When set, it takes over the countries/action/allow-empty-countries flags.")
+	var asnDbPath = flag.String("asn-db", "", "Path to a GeoLite2-ASN/GeoIP2-ASN database, required when the rules file contains \"asn\" matches.")
+	var metricsListenAddr = flag.String("metrics-listen", "", "If set, HTTP listener IP address and port for the Prometheus /metrics endpoint.")
+	var trustedProxiesFlag = flag.String("trusted-proxies", "", "Comma separated CIDRs (or bare IPs) of the reverse proxies allowed to set X-Forwarded-For/X-Real-IP. When set, requests whose direct peer isn't in this set are rejected with 403. Required to correctly resolve multi-hop X-Forwarded-For chains; without it, the left-most entry is used instead.")
 
 	flag.Parse()
 
@@ -60,15 +70,15 @@ func run() error {
 	}
 	logger := zlogger.Sugar()
 
-	if *action != "allow" && *action != "block" {
+	if *rulesPath == "" && *action != "allow" && *action != "block" {
 		logger.Fatal("Invalid action specified. Supported values are: allow, block")
 		return errors.New("invalid action flag value")
 	}
 
-	// Create a map for country codes for fast lookup
-	var countries = make(map[string]bool)
-	for _, c := range strings.Split(*countriesFlag, ",") {
-		countries[c] = true
+	trusted, err := parseTrustedProxies(*trustedProxiesFlag)
+	if err != nil {
+		logger.Errorw("invalid -trusted-proxies", "err", err)
+		return err
 	}
 
 	// Make a channel to listen for an interrupt or terminate signal from the OS.
@@ -80,40 +90,104 @@ func run() error {
 	// buffered channel so the goroutine can exit if we don't collect this error.
 	serverErrors := make(chan error, 1)
 
-	// Open MaxMind GeoIP database
-	mmdbfp, err := geoip2.Open(*dbpath)
+	// Resolve the configured -db-url to a local path, downloading/caching it first if it's remote.
+	source, err := newDBSource(*dbURL, *dbCacheDir)
+	if err != nil {
+		logger.Errorw("invalid -db-url", "err", err)
+		return err
+	}
+	dbPath, _, err := source.Resolve()
 	if err != nil {
-		logger.Errorw("can't open MaxMind database", "err", err)
+		logger.Errorw("can't resolve -db-url", "err", err)
 		return err
 	}
-	var mmdb = &mmdbfp
-	defer func() { _ = (*mmdb).Close() }()
 
-	// Refresh periodically MaxMind database by closing it and reopening it (as the downloader might have updated it)
-	go func() {
-		var t = time.NewTicker(*dbRefreshPeriod)
-		for range t.C {
-			logger.Debug("Trying to re-read the database from disk")
-			mmdbfp2, err := geoip2.Open(*dbpath)
-			if err != nil {
-				logger.Errorw("can't re-read MaxMind database", "err", err)
-				continue
-			}
-			// Swap the databases (mmdbfp1 is the old database, mmdbfp2 is the new one) and close the old one
-			mmdbfp1 := *mmdb
-			*mmdb = mmdbfp2
-
-			// Wait for in-flight HTTP requests to finish
-			time.Sleep(10 * time.Second)
-			_ = mmdbfp1.Close()
-			logger.Debug("MaxMind database reloaded successfully")
+	// If MaxMind credentials were supplied, make sure a fresh database is on disk before opening it, so that a
+	// first start on an empty volume doesn't require a separate geoipupdate run beforehand. This takes over
+	// keeping dbPath fresh from the generic source above.
+	maxmindCfg := maxmindConfig{
+		accountID:  *maxmindAccountID,
+		licenseKey: *maxmindLicenseKey,
+		editionID:  *maxmindEditionID,
+		maxAge:     *maxmindMaxAge,
+	}
+	var updater *maxmindUpdater
+	if maxmindCfg.enabled() {
+		updater = newMaxmindUpdater(maxmindCfg, dbPath, logger)
+		if _, err := updater.EnsureFresh(); err != nil {
+			logger.Errorw("can't download MaxMind database", "err", err)
+			return err
 		}
-	}()
+	}
+
+	// Open the GeoIP database
+	lookuper, err := openCountryLookuper(dbPath)
+	if err != nil {
+		logger.Errorw("can't open GeoIP database", "err", err)
+		return err
+	}
+	geoip := newLookuperStore(lookuper)
+	defer func() { _ = geoip.Close() }()
+	dbBuildEpoch.Set(float64(lookuper.Metadata().BuildEpoch))
+
+	// Open the (static, not hot-reloaded) ASN database used by "asn" rules, if any.
+	var asnReader *geoip2.Reader
+	if *asnDbPath != "" {
+		asnReader, err = geoip2.Open(*asnDbPath)
+		if err != nil {
+			logger.Errorw("can't open ASN database", "err", err)
+			return err
+		}
+		defer func() { _ = asnReader.Close() }()
+	}
+
+	// Build the ruleset that decides whether a request is allowed: either loaded from -rules, or synthesized
+	// from the legacy -countries/-action/-allow-empty-countries flags.
+	var rules []Rule
+	var defaultAction RuleAction
+	if *rulesPath != "" {
+		rules, defaultAction, err = LoadRules(*rulesPath)
+		if err != nil {
+			logger.Errorw("can't load rules file", "err", err)
+			return err
+		}
+	} else {
+		ruleAction := ActionDeny
+		defaultAction = ActionAllow
+		if *action == "allow" {
+			ruleAction = ActionAllow
+			defaultAction = ActionDeny
+		}
+		for _, c := range strings.Split(*countriesFlag, ",") {
+			rules = append(rules, Rule{Match: MatchCountry, Value: c, Action: ruleAction})
+		}
+	}
+	ruleset := NewRuleset(rules, defaultAction, *allowEmptyCountries, func(ip net.IP) (string, error) {
+		l, release := geoip.Acquire()
+		defer release()
+		return l.LookupCountry(ip)
+	}, asnReader)
+
+	// Refresh the database whenever it changes, either on the next tick or (when supported by the filesystem)
+	// as soon as it is written to.
+	refresh := func() (string, bool, error) {
+		if updater != nil {
+			changed, err := updater.EnsureFresh()
+			return dbPath, changed, err
+		}
+		return source.Resolve()
+	}
+	go watchForReloads(logger, *dbRefreshPeriod, dbPath, refresh, geoip)
+
+	if *metricsListenAddr != "" {
+		metricsServer := startMetricsServer(logger, *metricsListenAddr)
+		defer func() { _ = metricsServer.Close() }()
+	}
 
 	// Create the API server
 	httpserver := http.Server{
 		Addr:              *httpListenAddr,
-		Handler:           handleRequest(logger, mmdb, countries, *action == "allow", *allowEmptyCountries),
+		Handler:           handleRequest(logger, ruleset, trusted),
 		ReadTimeout:       *httpTimeouts,
 		ReadHeaderTimeout: *httpTimeouts,
 		WriteTimeout:      *httpTimeouts,
@@ -140,60 +214,58 @@ func run() error {
 	return nil
 }
 
-func handleRequest(logger *zap.SugaredLogger, mmdb **geoip2.Reader, countries map[string]bool, allowListMode bool, allowEmpty bool) http.HandlerFunc {
+func handleRequest(logger *zap.SugaredLogger, ruleset *Ruleset, trusted trustedProxies) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Retrieve the source IP address from Traefik
-		sourceIP := r.Header.Get("X-Forwarded-For")
-		if sourceIP == "" {
-			w.WriteHeader(http.StatusBadRequest)
-			return
+		inflightRequests.Inc()
+		defer inflightRequests.Dec()
+
+		// When trusted proxies are configured, refuse to trust forwarding headers unless the direct peer is
+		// one of them, so that spoofed X-Forwarded-For/X-Real-IP headers are rejected if this server is ever
+		// exposed directly instead of sitting behind Traefik.
+		if len(trusted) > 0 {
+			if peer := peerIP(r); peer == nil || !trusted.contains(peer) {
+				logger.Errorw("rejecting request from untrusted peer", "peer", r.RemoteAddr)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
 		}
 
-		// Parse the IP
-		ip := net.ParseIP(sourceIP)
+		ip := clientIP(r, trusted)
 		if ip == nil {
-			logger.Errorw("can't parse IP address", "source-ip", sourceIP)
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		// Lookup for the country from MaxMind
-		record, err := (*mmdb).Country(ip)
+		start := time.Now()
+		decision, err := ruleset.Evaluate(ip)
+		lookupDuration.Observe(time.Since(start).Seconds())
 		if err != nil {
-			logger.Errorw("MaxMind database lookup failed", "err", err)
+			logger.Errorw("ruleset evaluation failed", "err", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		if record.Country.IsoCode == "" && allowEmpty {
-			logger.Debugw("Access granted in allow empty country mode", "ip", ip)
+		requestsTotal.WithLabelValues(string(decision.Action), decision.Country, decisionMode(decision)).Inc()
+
+		if decision.Allowed() {
+			logger.Debugw("Access granted", "ip", ip, "country", decision.Country, "rule", decision.Rule)
 			w.WriteHeader(http.StatusOK)
-			return
-		} else if record.Country.IsoCode == "" && !allowEmpty {
-			logger.Debugw("Access blocked in !allow empty country mode", "ip", ip)
+		} else {
+			logger.Infow("Access denied", "ip", ip, "country", decision.Country, "rule", decision.Rule)
 			w.WriteHeader(http.StatusForbidden)
-			return
 		}
+	}
+}
 
-		// Check if the country is in the list of countries
-		if _, ok := countries[record.Country.IsoCode]; ok {
-			// If found, reply depending on the mode
-			if allowListMode {
-				logger.Debugw("Access granted in allowlist mode (found in country list)", "ip", ip, "country", record.Country.IsoCode)
-				w.WriteHeader(http.StatusOK)
-			} else {
-				logger.Debugw("Access blocked in blocklist mode (found in country list)", "ip", ip, "country", record.Country.IsoCode)
-				w.WriteHeader(http.StatusForbidden)
-			}
-		} else {
-			// If NOT found, reply depending on the mode
-			if allowListMode {
-				logger.Debugw("Access blocked in allowlist mode (NOT found in country list)", "ip", ip, "country", record.Country.IsoCode)
-				w.WriteHeader(http.StatusForbidden)
-			} else {
-				logger.Debugw("Access allowed in blocklist mode (NOT found in country list)", "ip", ip, "country", record.Country.IsoCode)
-				w.WriteHeader(http.StatusOK)
-			}
-		}
+// decisionMode labels how a Decision was reached, for the geoipauth_requests_total metric: by which rule type
+// matched, by the default action, or by the empty-country fallback.
+func decisionMode(d Decision) string {
+	switch {
+	case d.Rule != nil:
+		return string(d.Rule.Match)
+	case d.Country == "":
+		return "empty-country"
+	default:
+		return "default"
 	}
 }
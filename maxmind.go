@@ -0,0 +1,191 @@
+// Support for automatically downloading and refreshing the GeoLite2/GeoIP2 database straight from MaxMind,
+// so that deployments don't need a separate geoipupdate sidecar/cron job.
+// Copyright (C) 2023 Enrico Bassetti
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+const maxmindDownloadURL = "https://download.maxmind.com/app/geoip_download"
+
+// maxmindConfig holds the credentials and settings needed to fetch a database from MaxMind directly.
+type maxmindConfig struct {
+	accountID  string
+	licenseKey string
+	editionID  string
+	maxAge     time.Duration
+}
+
+// enabled reports whether enough information was supplied on the command line to manage the database automatically.
+func (c maxmindConfig) enabled() bool {
+	return c.accountID != "" && c.licenseKey != ""
+}
+
+// maxmindUpdater downloads and refreshes an MaxMind database file on disk, keeping track of the HTTP caching
+// headers returned by MaxMind so that unchanged databases are not re-downloaded on every check.
+type maxmindUpdater struct {
+	cfg    maxmindConfig
+	dbPath string
+	logger *zap.SugaredLogger
+	client *http.Client
+
+	etag         string
+	lastModified string
+}
+
+// newMaxmindUpdater creates an updater that keeps dbPath in sync with the MaxMind edition described by cfg.
+func newMaxmindUpdater(cfg maxmindConfig, dbPath string, logger *zap.SugaredLogger) *maxmindUpdater {
+	return &maxmindUpdater{
+		cfg:    cfg,
+		dbPath: dbPath,
+		logger: logger,
+		client: &http.Client{Timeout: 2 * time.Minute},
+	}
+}
+
+// EnsureFresh downloads the database if the local file is missing or older than the configured max age. It
+// returns whether a new file was written to dbPath.
+func (u *maxmindUpdater) EnsureFresh() (bool, error) {
+	if u.isFresh() {
+		return false, nil
+	}
+	return u.download()
+}
+
+// isFresh returns true when dbPath exists, is a readable MaxMind database, and its build epoch is within maxAge.
+func (u *maxmindUpdater) isFresh() bool {
+	reader, err := maxminddb.Open(u.dbPath)
+	if err != nil {
+		return false
+	}
+	defer func() { _ = reader.Close() }()
+
+	age := time.Since(time.Unix(int64(reader.Metadata.BuildEpoch), 0))
+	return age <= u.cfg.maxAge
+}
+
+// download fetches the tarball for the configured edition, conditionally on the caching headers recorded from the
+// previous successful download, and atomically extracts the .mmdb it contains into dbPath. It returns false,nil
+// when MaxMind reports the database hasn't changed since the last download.
+func (u *maxmindUpdater) download() (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, maxmindDownloadURL, nil)
+	if err != nil {
+		return false, fmt.Errorf("can't build MaxMind download request: %w", err)
+	}
+	req.SetBasicAuth(u.cfg.accountID, u.cfg.licenseKey)
+	req.URL.RawQuery = url.Values{
+		"edition_id":  {u.cfg.editionID},
+		"license_key": {u.cfg.licenseKey},
+		"suffix":      {"tar.gz"},
+	}.Encode()
+	if u.etag != "" {
+		req.Header.Set("If-None-Match", u.etag)
+	}
+	if u.lastModified != "" {
+		req.Header.Set("If-Modified-Since", u.lastModified)
+	}
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("can't download MaxMind database: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode == http.StatusNotModified {
+		u.logger.Debug("MaxMind database is already up to date")
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status downloading MaxMind database: %s", resp.Status)
+	}
+
+	if err := extractMmdbAtomically(resp.Body, u.dbPath); err != nil {
+		return false, err
+	}
+
+	u.etag = resp.Header.Get("ETag")
+	u.lastModified = resp.Header.Get("Last-Modified")
+
+	return true, nil
+}
+
+// extractMmdbAtomically reads a gzip-compressed tarball from r, finds the single .mmdb file it contains, and
+// writes it into destPath by renaming a temporary file in the same directory, so that readers never observe a
+// partially-written database.
+func extractMmdbAtomically(r io.Reader, destPath string) error {
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("can't decompress MaxMind tarball: %w", err)
+	}
+	defer func() { _ = gzr.Close() }()
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(destPath), ".mmdb-download-*")
+	if err != nil {
+		return fmt.Errorf("can't create temporary file for MaxMind database: %w", err)
+	}
+	tmpPath := tmpFile.Name()
+	defer func() {
+		_ = tmpFile.Close()
+		_ = os.Remove(tmpPath)
+	}()
+
+	tr := tar.NewReader(gzr)
+	found := false
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("can't read MaxMind tarball: %w", err)
+		}
+		if !strings.HasSuffix(hdr.Name, ".mmdb") {
+			continue
+		}
+		if _, err := io.Copy(tmpFile, tr); err != nil {
+			return fmt.Errorf("can't extract MaxMind database: %w", err)
+		}
+		found = true
+		break
+	}
+	if !found {
+		return errors.New("MaxMind tarball does not contain a .mmdb file")
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("can't finalize MaxMind database download: %w", err)
+	}
+	if err := os.Rename(tmpPath, destPath); err != nil {
+		return fmt.Errorf("can't install downloaded MaxMind database: %w", err)
+	}
+
+	return nil
+}
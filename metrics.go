@@ -0,0 +1,69 @@
+// Prometheus metrics exposed on a separate listener behind -metrics-listen.
+// Copyright (C) 2023 Enrico Bassetti
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+	"net/http"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "geoipauth_requests_total",
+		Help: "Total number of ForwardAuth requests, by decision, matched country and matching mode.",
+	}, []string{"decision", "country", "mode"})
+
+	lookupDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "geoipauth_lookup_duration_seconds",
+		Help: "Time taken to evaluate the ruleset for a request.",
+	})
+
+	dbReloadTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "geoipauth_db_reload_total",
+		Help: "Total number of database reload attempts, by result.",
+	}, []string{"result"})
+
+	dbBuildEpoch = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "geoipauth_db_build_epoch",
+		Help: "Build epoch (unix timestamp) of the currently loaded database.",
+	})
+
+	inflightRequests = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "geoipauth_inflight_requests",
+		Help: "Number of ForwardAuth requests currently being handled.",
+	})
+)
+
+// startMetricsServer starts a dedicated HTTP server exposing /metrics on listenAddr. Its lifetime is independent
+// from the main ForwardAuth server: a failure here is logged but does not bring the service down.
+func startMetricsServer(logger *zap.SugaredLogger, listenAddr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{Addr: listenAddr, Handler: mux}
+
+	go func() {
+		logger.Infof("metrics server listening on %s", server.Addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Errorw("metrics server error", "err", err)
+		}
+	}()
+
+	return server
+}
@@ -0,0 +1,174 @@
+// Race-free hot-reload of the GeoIP database: an atomic.Pointer swap so handleRequest never blocks on a lock,
+// reference counting so the previous database is only closed once in-flight requests are done with it, and an
+// fsnotify watch that triggers an immediate reload instead of waiting for the next ticker tick.
+// Copyright (C) 2023 Enrico Bassetti
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lookuperHandle pairs a CountryLookuper with a WaitGroup tracking its in-flight borrowers, so it can be closed
+// as soon as (and only once) nothing is using it anymore.
+type lookuperHandle struct {
+	lookuper CountryLookuper
+	refs     sync.WaitGroup
+}
+
+// lookuperStore holds the CountryLookuper currently in use, allowing concurrent reads from handleRequest while a
+// background goroutine swaps it out for a freshly-reloaded database. Acquire and Swap share an RWMutex solely
+// to make "load the current handle" and "increment its refcount" a single atomic step from Swap's point of
+// view: without it, a borrower could Load the handle right before Swap runs and call refs.Add(1) after Swap's
+// refs.Wait() already observed a zero count, closing the database out from under an in-flight lookup.
+type lookuperStore struct {
+	mu  sync.RWMutex
+	ptr atomic.Pointer[lookuperHandle]
+}
+
+// newLookuperStore creates a store initialized with the given lookuper.
+func newLookuperStore(initial CountryLookuper) *lookuperStore {
+	s := &lookuperStore{}
+	s.ptr.Store(&lookuperHandle{lookuper: initial})
+	return s
+}
+
+// Close releases the currently installed database. It is meant for final shutdown, not for use while reloads
+// may still be in flight.
+func (s *lookuperStore) Close() error {
+	return s.ptr.Load().lookuper.Close()
+}
+
+// Acquire returns the current CountryLookuper together with a release function that the caller must invoke once
+// done with it, so that Swap knows when it is safe to close a replaced database.
+func (s *lookuperStore) Acquire() (CountryLookuper, func()) {
+	s.mu.RLock()
+	h := s.ptr.Load()
+	h.refs.Add(1)
+	s.mu.RUnlock()
+	return h.lookuper, h.refs.Done
+}
+
+// Swap installs newLookuper as the current database and closes the previous one in the background, once its
+// last borrower has released it.
+func (s *lookuperStore) Swap(newLookuper CountryLookuper, logger *zap.SugaredLogger) {
+	s.mu.Lock()
+	old := s.ptr.Swap(&lookuperHandle{lookuper: newLookuper})
+	s.mu.Unlock()
+
+	go func() {
+		old.refs.Wait()
+		if err := old.lookuper.Close(); err != nil {
+			logger.Errorw("can't close previous GeoIP database", "err", err)
+		}
+	}()
+}
+
+// refreshFunc resolves the database to use, returning its current local path and whether it changed since the
+// last call. It is satisfied by a closure wrapping either a maxmindUpdater or a dbSource.
+type refreshFunc func() (path string, changed bool, err error)
+
+// watchForReloads runs until the process exits, reloading the database into store whenever refresh reports a
+// change. Reloads are triggered by refreshPeriod ticks, and - when a filesystem watch on dbPath's directory can
+// be established - immediately on write/create/rename events for dbPath, so that updates don't wait for the
+// next tick. The ticker always remains active as a fallback for filesystems that don't deliver fsnotify events
+// (e.g. some bind-mounted Docker volumes).
+func watchForReloads(logger *zap.SugaredLogger, refreshPeriod time.Duration, dbPath string, refresh refreshFunc, store *lookuperStore) {
+	watcher, watcherEvents, watcherErrors := startWatcher(logger, dbPath)
+	if watcher != nil {
+		defer func() { _ = watcher.Close() }()
+	}
+
+	ticker := time.NewTicker(refreshPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			reloadIfChanged(logger, "ticker", &dbPath, refresh, store)
+
+		case event, ok := <-watcherEvents:
+			if !ok {
+				watcherEvents = nil
+				continue
+			}
+			if filepath.Clean(event.Name) != filepath.Clean(dbPath) {
+				continue
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			reloadIfChanged(logger, "fsnotify", &dbPath, refresh, store)
+
+		case err, ok := <-watcherErrors:
+			if !ok {
+				watcherErrors = nil
+				continue
+			}
+			logger.Errorw("database watcher error", "err", err)
+		}
+	}
+}
+
+// startWatcher sets up an fsnotify watch on dbPath's directory. It returns nil channels (which block forever in
+// a select) if the watcher can't be created, so that callers keep working off the ticker alone.
+func startWatcher(logger *zap.SugaredLogger, dbPath string) (*fsnotify.Watcher, chan fsnotify.Event, chan error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Warnw("can't create database file watcher, relying on the refresh ticker only", "err", err)
+		return nil, nil, nil
+	}
+	if err := watcher.Add(filepath.Dir(dbPath)); err != nil {
+		logger.Warnw("can't watch database directory, relying on the refresh ticker only", "err", err)
+		_ = watcher.Close()
+		return nil, nil, nil
+	}
+	return watcher, watcher.Events, watcher.Errors
+}
+
+// reloadIfChanged calls refresh and, if it reports a change, reopens the database at its (possibly new) path and
+// installs it into store.
+func reloadIfChanged(logger *zap.SugaredLogger, trigger string, dbPath *string, refresh refreshFunc, store *lookuperStore) {
+	path, changed, err := refresh()
+	if err != nil {
+		dbReloadTotal.WithLabelValues("error").Inc()
+		logger.Errorw("can't refresh GeoIP database", "trigger", trigger, "err", err)
+		return
+	}
+	*dbPath = path
+	if !changed {
+		dbReloadTotal.WithLabelValues("unchanged").Inc()
+		logger.Debugw("GeoIP database unchanged, skipping reload", "trigger", trigger)
+		return
+	}
+
+	logger.Debugw("reloading GeoIP database", "trigger", trigger)
+	newLookuper, err := openCountryLookuper(path)
+	if err != nil {
+		dbReloadTotal.WithLabelValues("error").Inc()
+		logger.Errorw("can't re-read GeoIP database", "trigger", trigger, "err", err)
+		return
+	}
+	store.Swap(newLookuper, logger)
+	dbReloadTotal.WithLabelValues("success").Inc()
+	dbBuildEpoch.Set(float64(newLookuper.Metadata().BuildEpoch))
+	logger.Debugw("GeoIP database reloaded successfully", "trigger", trigger)
+}
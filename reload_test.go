@@ -0,0 +1,97 @@
+package main
+
+import (
+	"github.com/oschwald/maxminddb-golang"
+	"go.uber.org/zap"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeLookuper is a minimal CountryLookuper used to exercise lookuperStore without a real database file.
+type fakeLookuper struct {
+	closed int32
+}
+
+func (f *fakeLookuper) LookupCountry(net.IP) (string, error) { return "", nil }
+func (f *fakeLookuper) Metadata() maxminddb.Metadata         { return maxminddb.Metadata{} }
+func (f *fakeLookuper) Close() error {
+	atomic.AddInt32(&f.closed, 1)
+	return nil
+}
+
+func TestLookuperStoreSwapClosesOldOnlyAfterLastBorrowerReleases(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+
+	first := &fakeLookuper{}
+	store := newLookuperStore(first)
+
+	lookuper, release := store.Acquire()
+	if lookuper != first {
+		t.Fatalf("Acquire() returned %v, want the initial lookuper", lookuper)
+	}
+
+	second := &fakeLookuper{}
+	store.Swap(second, logger)
+
+	// The borrower is still holding the handle, so the old lookuper must not be closed yet.
+	time.Sleep(10 * time.Millisecond)
+	if atomic.LoadInt32(&first.closed) != 0 {
+		t.Fatal("old lookuper was closed while a borrower still held it")
+	}
+
+	release()
+
+	// Now that the only borrower released it, Swap's background goroutine should close it shortly.
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&first.closed) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("old lookuper was never closed after its last borrower released it")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, release2 := store.Acquire(); true {
+		release2()
+	}
+}
+
+// TestLookuperStoreAcquireSwapRace exercises Acquire and Swap concurrently; run with -race to catch the borrowed
+// handle being closed out from under an in-flight Acquire.
+func TestLookuperStoreAcquireSwapRace(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	store := newLookuperStore(&fakeLookuper{})
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			store.Swap(&fakeLookuper{}, logger)
+		}
+		close(stop)
+	}()
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				l, release := store.Acquire()
+				_, _ = l.LookupCountry(net.ParseIP("1.2.3.4"))
+				release()
+			}
+		}()
+	}
+
+	wg.Wait()
+}
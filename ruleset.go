@@ -0,0 +1,209 @@
+// The rule-based allow/block engine, matching requests against an ordered list of country, ASN and CIDR rules.
+// Copyright (C) 2023 Enrico Bassetti
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/oschwald/geoip2-golang"
+	"gopkg.in/yaml.v3"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MatchKind identifies what a Rule compares against the request's source IP.
+type MatchKind string
+
+const (
+	MatchCountry MatchKind = "country"
+	MatchASN     MatchKind = "asn"
+	MatchCIDR    MatchKind = "cidr"
+)
+
+// RuleAction is the outcome of a matched Rule, or of a Ruleset's default action.
+type RuleAction string
+
+const (
+	ActionAllow RuleAction = "allow"
+	ActionDeny  RuleAction = "deny"
+)
+
+// Rule is a single ordered entry of a Ruleset, e.g. "country IT" or "cidr 10.0.0.0/8".
+type Rule struct {
+	Match  MatchKind
+	Value  string
+	Action RuleAction
+
+	// cidr is the parsed form of Value for MatchCIDR rules, computed once when the Ruleset is built.
+	cidr *net.IPNet
+}
+
+// Decision is the result of evaluating a Ruleset against an IP address.
+type Decision struct {
+	Action  RuleAction
+	Rule    *Rule // the rule that matched, nil if the default action or the empty-country fallback applied
+	Country string
+}
+
+// Allowed reports whether d lets the request through.
+func (d Decision) Allowed() bool {
+	return d.Action == ActionAllow
+}
+
+// Ruleset evaluates an IP address against an ordered list of country/ASN/CIDR rules, first-match-wins, falling
+// back to a default action. Country and ASN rules are only evaluated when the corresponding lookup function was
+// configured.
+type Ruleset struct {
+	rules             []Rule
+	defaultAction     RuleAction
+	allowEmptyCountry bool
+
+	lookupCountry func(ip net.IP) (string, error)
+	asnReader     *geoip2.Reader
+}
+
+// NewRuleset builds a Ruleset. lookupCountry and asnReader may be nil when the corresponding rule types aren't
+// needed; a rule referencing an unavailable lookup is simply never matched.
+func NewRuleset(rules []Rule, defaultAction RuleAction, allowEmptyCountry bool, lookupCountry func(net.IP) (string, error), asnReader *geoip2.Reader) *Ruleset {
+	return &Ruleset{
+		rules:             rules,
+		defaultAction:     defaultAction,
+		allowEmptyCountry: allowEmptyCountry,
+		lookupCountry:     lookupCountry,
+		asnReader:         asnReader,
+	}
+}
+
+// Evaluate matches ip against the ruleset and returns the resulting Decision. ASN and CIDR rules are always
+// consulted regardless of country (private ranges and sing-geoip gaps still need to hit them); only once no
+// rule matches does an empty country lookup override the default action with allowEmptyCountry, preserving the
+// previous "allow/block empty country" behaviour.
+func (rs *Ruleset) Evaluate(ip net.IP) (Decision, error) {
+	var country string
+	var emptyCountry bool
+	if rs.lookupCountry != nil {
+		c, err := rs.lookupCountry(ip)
+		if err != nil {
+			return Decision{}, fmt.Errorf("country lookup failed: %w", err)
+		}
+		country = c
+		emptyCountry = country == ""
+	}
+
+	for i := range rs.rules {
+		rule := &rs.rules[i]
+		switch rule.Match {
+		case MatchCountry:
+			if country != "" && country == rule.Value {
+				return Decision{Action: rule.Action, Rule: rule, Country: country}, nil
+			}
+
+		case MatchASN:
+			if rs.asnReader == nil {
+				continue
+			}
+			record, err := rs.asnReader.ASN(ip)
+			if err != nil {
+				continue
+			}
+			if fmt.Sprintf("AS%d", record.AutonomousSystemNumber) == rule.Value {
+				return Decision{Action: rule.Action, Rule: rule, Country: country}, nil
+			}
+
+		case MatchCIDR:
+			if rule.cidr != nil && rule.cidr.Contains(ip) {
+				return Decision{Action: rule.Action, Rule: rule, Country: country}, nil
+			}
+		}
+	}
+
+	if emptyCountry {
+		action := ActionDeny
+		if rs.allowEmptyCountry {
+			action = ActionAllow
+		}
+		return Decision{Action: action, Country: country}, nil
+	}
+
+	return Decision{Action: rs.defaultAction, Country: country}, nil
+}
+
+// rulesFile is the on-disk representation loaded from the -rules flag, in either YAML or JSON.
+type rulesFile struct {
+	Default string `yaml:"default" json:"default"`
+	Rules   []struct {
+		Match  string `yaml:"match" json:"match"`
+		Value  string `yaml:"value" json:"value"`
+		Action string `yaml:"action" json:"action"`
+	} `yaml:"rules" json:"rules"`
+}
+
+// LoadRules reads and validates the rules file at path, returning its ordered rules and default action. The
+// format (YAML or JSON) is picked from the file extension; any extension other than ".json" is parsed as YAML,
+// which is a superset of JSON.
+func LoadRules(path string) ([]Rule, RuleAction, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("can't read rules file: %w", err)
+	}
+
+	var rf rulesFile
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(data, &rf)
+	} else {
+		err = yaml.Unmarshal(data, &rf)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("can't parse rules file: %w", err)
+	}
+
+	defaultAction := RuleAction(rf.Default)
+	if defaultAction != ActionAllow && defaultAction != ActionDeny {
+		return nil, "", fmt.Errorf("invalid default action %q, must be \"allow\" or \"deny\"", rf.Default)
+	}
+
+	rules := make([]Rule, 0, len(rf.Rules))
+	for _, entry := range rf.Rules {
+		rule := Rule{
+			Match:  MatchKind(entry.Match),
+			Value:  entry.Value,
+			Action: RuleAction(entry.Action),
+		}
+		if rule.Action != ActionAllow && rule.Action != ActionDeny {
+			return nil, "", fmt.Errorf("invalid action %q for rule matching %q", entry.Action, entry.Value)
+		}
+
+		switch rule.Match {
+		case MatchCountry, MatchASN:
+			// Value is compared as-is against the looked-up country code / "ASnnnn" string.
+		case MatchCIDR:
+			_, cidr, err := net.ParseCIDR(entry.Value)
+			if err != nil {
+				return nil, "", fmt.Errorf("invalid CIDR %q: %w", entry.Value, err)
+			}
+			rule.cidr = cidr
+		default:
+			return nil, "", fmt.Errorf("unknown match kind %q, must be \"country\", \"asn\" or \"cidr\"", entry.Match)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, defaultAction, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRulesetEvaluate(t *testing.T) {
+	cidrRule := Rule{Match: MatchCIDR, Value: "10.0.0.0/8", Action: ActionAllow}
+	_, cidrRule.cidr, _ = net.ParseCIDR(cidrRule.Value)
+
+	countryRule := Rule{Match: MatchCountry, Value: "IT", Action: ActionDeny}
+
+	tests := []struct {
+		name              string
+		rules             []Rule
+		defaultAction     RuleAction
+		allowEmptyCountry bool
+		lookupCountry     func(net.IP) (string, error)
+		ip                string
+		wantAction        RuleAction
+	}{
+		{
+			name:          "country rule matches",
+			rules:         []Rule{countryRule},
+			defaultAction: ActionAllow,
+			lookupCountry: func(net.IP) (string, error) { return "IT", nil },
+			ip:            "1.2.3.4",
+			wantAction:    ActionDeny,
+		},
+		{
+			name:          "CIDR rule matches despite empty country",
+			rules:         []Rule{cidrRule},
+			defaultAction: ActionDeny,
+			lookupCountry: func(net.IP) (string, error) { return "", nil },
+			ip:            "10.1.2.3",
+			wantAction:    ActionAllow,
+		},
+		{
+			name:              "empty country falls back to allowEmptyCountry only after no rule matches",
+			rules:             []Rule{cidrRule},
+			defaultAction:     ActionAllow,
+			allowEmptyCountry: true,
+			lookupCountry:     func(net.IP) (string, error) { return "", nil },
+			ip:                "192.168.1.1",
+			wantAction:        ActionAllow,
+		},
+		{
+			name:              "empty country denies when allowEmptyCountry is false",
+			rules:             []Rule{cidrRule},
+			defaultAction:     ActionAllow,
+			allowEmptyCountry: false,
+			lookupCountry:     func(net.IP) (string, error) { return "", nil },
+			ip:                "192.168.1.1",
+			wantAction:        ActionDeny,
+		},
+		{
+			name:          "no rule matches, no country lookup configured, falls back to default action",
+			rules:         []Rule{countryRule},
+			defaultAction: ActionAllow,
+			ip:            "1.2.3.4",
+			wantAction:    ActionAllow,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := NewRuleset(tt.rules, tt.defaultAction, tt.allowEmptyCountry, tt.lookupCountry, nil)
+			decision, err := rs.Evaluate(net.ParseIP(tt.ip))
+			if err != nil {
+				t.Fatalf("Evaluate: unexpected error: %v", err)
+			}
+			if decision.Action != tt.wantAction {
+				t.Errorf("Evaluate() action = %q, want %q", decision.Action, tt.wantAction)
+			}
+		})
+	}
+}
+
+func TestRulesetEvaluateLookupError(t *testing.T) {
+	wantErr := net.InvalidAddrError("boom")
+	rs := NewRuleset(nil, ActionAllow, false, func(net.IP) (string, error) { return "", wantErr }, nil)
+
+	_, err := rs.Evaluate(net.ParseIP("1.2.3.4"))
+	if err == nil {
+		t.Fatal("Evaluate: expected error, got nil")
+	}
+}
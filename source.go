@@ -0,0 +1,224 @@
+// Fetching and caching of the GeoIP database from the locations supported by the -db-url flag: local files,
+// plain HTTP(S) downloads, and S3 buckets.
+// Copyright (C) 2023 Enrico Bassetti
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// dbSource resolves a -db-url value to a local file path, fetching and caching it as needed.
+type dbSource interface {
+	// Resolve makes sure the database is present locally and returns its path, plus whether this call changed
+	// the file on disk (so callers can decide whether a reload is necessary).
+	Resolve() (path string, changed bool, err error)
+}
+
+// newDBSource builds the dbSource matching the scheme of rawURL. Remote sources cache the downloaded database
+// under cacheDir.
+func newDBSource(rawURL string, cacheDir string) (dbSource, error) {
+	// A bare path (the common case, and the flag's default) has no "://" and should be treated as a local file
+	// rather than rejected for having an empty scheme.
+	if !strings.Contains(rawURL, "://") {
+		return &fileSource{path: rawURL}, nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse -db-url: %w", err)
+	}
+
+	switch u.Scheme {
+	case "file":
+		// "file:///abs/path" parses with an empty Host and the path in Path; "file://relative/path" parses
+		// with Host="relative" and the rest in Path, since there's no leading slash to mark it absolute.
+		path := filepath.Join(u.Host, u.Path)
+		if path == "" {
+			return nil, fmt.Errorf("invalid -db-url %q: empty file path", rawURL)
+		}
+		return &fileSource{path: path}, nil
+
+	case "http", "https":
+		return &httpSource{
+			url:       rawURL,
+			cachePath: cachePath(cacheDir, rawURL),
+			client:    &http.Client{Timeout: 2 * time.Minute},
+		}, nil
+
+	case "s3":
+		return &s3Source{
+			bucket:    u.Host,
+			key:       strings.TrimPrefix(u.Path, "/"),
+			cachePath: cachePath(cacheDir, rawURL),
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q in -db-url", u.Scheme)
+	}
+}
+
+// cachePath computes a stable local cache file name for a remote database URL.
+func cachePath(cacheDir string, rawURL string) string {
+	sum := sha256.Sum256([]byte(rawURL))
+	return filepath.Join(cacheDir, hex.EncodeToString(sum[:8])+".mmdb")
+}
+
+// fileSource serves a database that already lives on the local filesystem. There is no cheap way to tell
+// whether the file changed since the last check (it might be replaced by an external process such as
+// geoipupdate), so Resolve conservatively reports it as always changed, matching the blind periodic reopen the
+// service has always done for local files.
+type fileSource struct {
+	path string
+}
+
+func (s *fileSource) Resolve() (string, bool, error) {
+	return s.path, true, nil
+}
+
+// httpSource downloads a database over HTTP(S) into cachePath, skipping the download when the server reports
+// the content hasn't changed since the last fetch via ETag/Last-Modified.
+type httpSource struct {
+	url       string
+	cachePath string
+	client    *http.Client
+
+	etag         string
+	lastModified string
+}
+
+func (s *httpSource) Resolve() (string, bool, error) {
+	req, err := http.NewRequest(http.MethodGet, s.url, nil)
+	if err != nil {
+		return "", false, fmt.Errorf("can't build request for -db-url: %w", err)
+	}
+	if s.etag != "" {
+		req.Header.Set("If-None-Match", s.etag)
+	}
+	if s.lastModified != "" {
+		req.Header.Set("If-Modified-Since", s.lastModified)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", false, fmt.Errorf("can't download %s: %w", s.url, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return s.cachePath, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", false, fmt.Errorf("unexpected status downloading %s: %s", s.url, resp.Status)
+	}
+
+	if err := writeFileAtomically(resp.Body, s.cachePath); err != nil {
+		return "", false, err
+	}
+
+	s.etag = resp.Header.Get("ETag")
+	s.lastModified = resp.Header.Get("Last-Modified")
+
+	return s.cachePath, true, nil
+}
+
+// s3Source downloads a database from an S3 bucket into cachePath, using the default AWS credential chain
+// (environment variables, shared config, instance/task role, ...).
+type s3Source struct {
+	bucket    string
+	key       string
+	cachePath string
+
+	etag string
+}
+
+func (s *s3Source) Resolve() (string, bool, error) {
+	ctx := context.Background()
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return "", false, fmt.Errorf("can't load AWS configuration: %w", err)
+	}
+	client := s3.NewFromConfig(cfg)
+
+	out, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key),
+	})
+	if err != nil {
+		return "", false, fmt.Errorf("can't download s3://%s/%s: %w", s.bucket, s.key, err)
+	}
+	defer func() { _ = out.Body.Close() }()
+
+	// S3's GetObject API has no equivalent of HTTP conditional requests exposed by the SDK, so the object is
+	// always fetched; its ETag (the source's content hash) tells us whether it actually changed.
+	if out.ETag != nil && *out.ETag == s.etag {
+		return s.cachePath, false, nil
+	}
+
+	if err := writeFileAtomically(out.Body, s.cachePath); err != nil {
+		return "", false, err
+	}
+
+	if out.ETag != nil {
+		s.etag = *out.ETag
+	}
+
+	return s.cachePath, true, nil
+}
+
+// writeFileAtomically writes r into destPath by renaming a temporary file created alongside it, so that readers
+// never observe a partially-written database.
+func writeFileAtomically(r io.Reader, destPath string) error {
+	if err := os.MkdirAll(filepath.Dir(destPath), 0o755); err != nil {
+		return fmt.Errorf("can't create cache directory: %w", err)
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(destPath), ".mmdb-download-*")
+	if err != nil {
+		return fmt.Errorf("can't create temporary file: %w", err)
+	}
+	tmpPath := tmpFile.Name()
+	defer func() {
+		_ = tmpFile.Close()
+		_ = os.Remove(tmpPath)
+	}()
+
+	if _, err := io.Copy(tmpFile, r); err != nil {
+		return fmt.Errorf("can't write downloaded database: %w", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("can't finalize downloaded database: %w", err)
+	}
+	if err := os.Rename(tmpPath, destPath); err != nil {
+		return fmt.Errorf("can't install downloaded database: %w", err)
+	}
+
+	return nil
+}
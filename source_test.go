@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNewDBSource(t *testing.T) {
+	tests := []struct {
+		name     string
+		rawURL   string
+		wantErr  bool
+		wantPath string // only checked for fileSource results
+	}{
+		{name: "bare path uses the default backward-compatible behavior", rawURL: "GeoLite2-Country.mmdb", wantPath: "GeoLite2-Country.mmdb"},
+		{name: "bare absolute path", rawURL: "/var/lib/GeoLite2-Country.mmdb", wantPath: "/var/lib/GeoLite2-Country.mmdb"},
+		{name: "file:// absolute path", rawURL: "file:///var/lib/GeoLite2-Country.mmdb", wantPath: "/var/lib/GeoLite2-Country.mmdb"},
+		{name: "file:// relative path", rawURL: "file://db.mmdb", wantPath: "db.mmdb"},
+		{name: "file:// with empty path is rejected", rawURL: "file://", wantErr: true},
+		{name: "http URL", rawURL: "http://example.com/db.mmdb"},
+		{name: "https URL", rawURL: "https://example.com/db.mmdb"},
+		{name: "s3 URL", rawURL: "s3://bucket/key.mmdb"},
+		{name: "unsupported scheme", rawURL: "ftp://example.com/db.mmdb", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, err := newDBSource(tt.rawURL, t.TempDir())
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("newDBSource(%q): expected error, got nil", tt.rawURL)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newDBSource(%q): unexpected error: %v", tt.rawURL, err)
+			}
+
+			if tt.wantPath != "" {
+				fs, ok := src.(*fileSource)
+				if !ok {
+					t.Fatalf("newDBSource(%q): got %T, want *fileSource", tt.rawURL, src)
+				}
+				if fs.path != tt.wantPath {
+					t.Errorf("newDBSource(%q): path = %q, want %q", tt.rawURL, fs.path, tt.wantPath)
+				}
+			}
+		})
+	}
+}